@@ -0,0 +1,46 @@
+package dvara
+
+import (
+	"fmt"
+	"net"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// sendAdminCommand writes a one-off OP_MSG command to upstream against the
+// admin database, reads back its reply, and reports an error if the server
+// itself rejected the command. It is used for commands dvara synthesizes
+// itself, outside of any client request, such as endSessions on disconnect.
+func sendAdminCommand(upstream net.Conn, cmd bson.D) error {
+	cmd = append(cmd, bson.DocElem{Name: "$db", Value: "admin"})
+	body, err := bson.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	msg := &OpMsgMessage{Body: bson.Raw{Kind: 0x03, Data: body}}
+	if err := msg.writeTo(upstream); err != nil {
+		return err
+	}
+
+	header, err := readMsgHeader(upstream)
+	if err != nil {
+		return err
+	}
+	reply, err := readOpMsgMessage(header, upstream)
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		OK     float64 `bson:"ok"`
+		ErrMsg string  `bson:"errmsg"`
+	}
+	if err := reply.Body.Unmarshal(&result); err != nil {
+		return err
+	}
+	if result.OK != 1 {
+		return fmt.Errorf("dvara: admin command failed: %s", result.ErrMsg)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package dvara
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// sessionIdleTimeout mirrors the server's own idle session timeout: an
+// affinity entry nobody has touched in this long is treated as expired,
+// the same as if endSessions had already released it.
+const sessionIdleTimeout = 30 * time.Minute
+
+// pinnedUpstream is an upstream connection that may end up shared by more
+// than one client connection once a logical session pins it, so every
+// request/reply round trip runs under its mutex and the wire protocol
+// stream is never interleaved between the clients sharing it. refCount
+// counts the references client connections currently hold on this socket —
+// one for the connection that dialed it, plus one more each time another
+// connection first uses a session pinned to it (a connection sharing two
+// such sessions holds two) — so it is only closed once none of them need
+// it any more.
+type pinnedUpstream struct {
+	mutex    sync.Mutex
+	conn     net.Conn
+	refCount int
+}
+
+// newPinnedUpstream wraps conn on behalf of the client connection that
+// dialed it, which counts as this upstream's first reference.
+func newPinnedUpstream(conn net.Conn) *pinnedUpstream {
+	return &pinnedUpstream{conn: conn, refCount: 1}
+}
+
+// do runs fn with exclusive access to the pinned connection.
+func (p *pinnedUpstream) do(fn func(net.Conn) error) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return fn(p.conn)
+}
+
+// addRef records one more reference to this upstream socket, taken by a
+// client connection other than the one that dialed it when it first uses a
+// session pinned here.
+func (p *pinnedUpstream) addRef() {
+	p.mutex.Lock()
+	p.refCount++
+	p.mutex.Unlock()
+}
+
+// release drops one reference, closing the underlying connection once
+// nothing relies on it any more.
+func (p *pinnedUpstream) release() {
+	p.mutex.Lock()
+	p.refCount--
+	done := p.refCount <= 0
+	p.mutex.Unlock()
+	if done {
+		p.conn.Close()
+	}
+}
+
+type affinityEntry struct {
+	upstream *pinnedUpstream
+	lastUsed time.Time
+	// refCount is the number of client connections currently relying on
+	// this lsid staying alive upstream — every connection that has
+	// observed it at least once, since each one will try to end it on
+	// disconnect. The session is only actually ended once this reaches
+	// zero, so one connection disconnecting never kills a session a
+	// different connection is still using (e.g. mid-transaction).
+	refCount int
+	// generation distinguishes this entry from whatever entry previously
+	// occupied the same lsid key and has since idle-timed-out: a release
+	// call meant for the old, already-expired entry must not be allowed to
+	// tear down a completely different connection's fresh pin that just
+	// happens to reuse the same map key.
+	generation uint64
+}
+
+// sessionAffinity pins the upstream connection a logical session's commands
+// are dispatched to, so that a multi-statement transaction or a pair of
+// causally consistent reads sharing an lsid always land on the same mongod
+// socket, no matter which client-side connection carries them.
+type sessionAffinity struct {
+	mutex          sync.Mutex
+	entries        map[string]*affinityEntry
+	nextGeneration uint64
+}
+
+// acquire pins dflt as the upstream connection for lsid if it is not
+// pinned already (or the previous pin has gone idle past
+// sessionIdleTimeout), and reports whether this was the first connection
+// to ever pin lsid. Every reuse of an existing pin necessarily belongs to
+// some other connection (each connection only ever calls acquire for a
+// given lsid once, the first time it observes it, and always passes its
+// own freshly dialed upstream as dflt), so callers must hold onto target
+// and release it once their own connection goes away whenever created is
+// false. expired reports whether this call replaced an idle-expired entry;
+// the caller should fold that straight into its closed-session accounting
+// as one closed session, since the server itself has already forgotten it
+// the same way an explicit endSessions would have — however many
+// connections the stale entry's refCount still listed, Stats only ever
+// counted it as one session opened in the first place. Callers must
+// remember the returned generation and pass it back to release.
+func (a *sessionAffinity) acquire(lsid bson.Raw, dflt *pinnedUpstream) (target *pinnedUpstream, created bool, generation uint64, expired bool) {
+	key := string(lsid.Data)
+	now := time.Now()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.entries == nil {
+		a.entries = make(map[string]*affinityEntry)
+	}
+
+	e, ok := a.entries[key]
+	if ok && now.Sub(e.lastUsed) < sessionIdleTimeout {
+		e.lastUsed = now
+		e.refCount++
+		e.upstream.addRef()
+		return e.upstream, false, e.generation, false
+	}
+
+	a.nextGeneration++
+	fresh := &affinityEntry{upstream: dflt, lastUsed: now, refCount: 1, generation: a.nextGeneration}
+	a.entries[key] = fresh
+	return dflt, true, fresh.generation, ok
+}
+
+// lookup returns the upstream connection already pinned to lsid without
+// touching any refcount, falling back to dflt if it has none (or has gone
+// idle, in which case the stale entry is discarded so it doesn't linger
+// forever, and expired reports true so the caller can account for the
+// closed session — mirroring acquire's own expired reporting). Used for
+// every message after the one that called acquire, on the same client
+// connection.
+func (a *sessionAffinity) lookup(lsid bson.Raw, dflt *pinnedUpstream) (target *pinnedUpstream, expired bool) {
+	key := string(lsid.Data)
+	now := time.Now()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if e, ok := a.entries[key]; ok {
+		if now.Sub(e.lastUsed) < sessionIdleTimeout {
+			e.lastUsed = now
+			return e.upstream, false
+		}
+		delete(a.entries, key)
+		return dflt, true
+	}
+	return dflt, false
+}
+
+// release drops one reference to every session in sessions — one client
+// connection that observed it has gone away — and reports the lsids that
+// dropped to zero references and were forgotten. Only those have no client
+// connection left relying on them and should actually be ended upstream;
+// the rest are still in use elsewhere (for example a different connection
+// carrying the same session mid-transaction) and must be left alone. A
+// session whose generation no longer matches the live entry (or which has
+// no live entry at all) has already been superseded or expired and is
+// silently skipped, rather than tearing down whatever unrelated session
+// now occupies that lsid.
+//
+// The entry is forgotten here unconditionally, before the caller has tried
+// to actually send endSessions upstream: once its refCount reaches zero no
+// client connection relies on the session any more, so nothing will route
+// to it through this entry again. If the caller's endSessions
+// send then fails, mongod is left to forget the session on its own via its
+// usual idle timeout — the same fallback as if dvara didn't track sessions
+// at all.
+func (a *sessionAffinity) release(sessions []trackedSession) []bson.Raw {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var freed []bson.Raw
+	for _, s := range sessions {
+		key := string(s.lsid.Data)
+		e, ok := a.entries[key]
+		if !ok || e.generation != s.generation {
+			continue
+		}
+		e.refCount--
+		if e.refCount <= 0 {
+			delete(a.entries, key)
+			freed = append(freed, s.lsid)
+		}
+	}
+	return freed
+}
@@ -0,0 +1,207 @@
+// +build integration
+
+package dvara
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	mgobson "gopkg.in/mgo.v2/bson"
+)
+
+// faultyLink is a TCP relay the chaos harness inserts between a Proxy and
+// a real mongod member, so fault scenarios can manipulate the connection
+// in flight: delay bytes, reset it outright with a TCP RST, or black-hole
+// it entirely, all without the mongod process itself ever knowing.
+type faultyLink struct {
+	upstream string
+	listener net.Listener
+
+	mutex       sync.Mutex
+	latency     time.Duration
+	partitioned bool
+	conns       []net.Conn
+}
+
+// newFaultyLink starts relaying connections to upstream through a freshly
+// allocated local port.
+func newFaultyLink(tb testing.TB, upstream string) *faultyLink {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fatalf(tb, "could not start faulty link: %s", err)
+	}
+	f := &faultyLink{upstream: upstream, listener: l}
+	go f.acceptLoop()
+	return f
+}
+
+// Addr is the local address clients (ordinarily a Proxy) should dial
+// instead of the real upstream.
+func (f *faultyLink) Addr() string { return f.listener.Addr().String() }
+
+func (f *faultyLink) acceptLoop() {
+	for {
+		c, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		up, err := net.Dial("tcp", f.upstream)
+		if err != nil {
+			c.Close()
+			continue
+		}
+		f.track(c)
+		f.track(up)
+		go f.pipe(c, up)
+		go f.pipe(up, c)
+	}
+}
+
+func (f *faultyLink) track(c net.Conn) {
+	f.mutex.Lock()
+	f.conns = append(f.conns, c)
+	f.mutex.Unlock()
+}
+
+func (f *faultyLink) pipe(dst, src net.Conn) {
+	defer dst.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		f.mutex.Lock()
+		partitioned := f.partitioned
+		latency := f.latency
+		f.mutex.Unlock()
+
+		if partitioned {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// SetLatency delays every byte relayed through the link by d, simulating
+// a slow upstream member.
+func (f *faultyLink) SetLatency(d time.Duration) {
+	f.mutex.Lock()
+	f.latency = d
+	f.mutex.Unlock()
+}
+
+// Partition black-holes the link: nothing new is relayed in either
+// direction until Heal is called, simulating a network partition.
+func (f *faultyLink) Partition() {
+	f.mutex.Lock()
+	f.partitioned = true
+	f.mutex.Unlock()
+}
+
+// Heal reverses Partition.
+func (f *faultyLink) Heal() {
+	f.mutex.Lock()
+	f.partitioned = false
+	f.mutex.Unlock()
+}
+
+// Reset forcibly closes every connection the link has relayed so far with
+// a TCP RST (via SO_LINGER 0), simulating an upstream socket reset
+// mid-reply.
+func (f *faultyLink) Reset() {
+	f.mutex.Lock()
+	conns := f.conns
+	f.conns = nil
+	f.mutex.Unlock()
+
+	for _, c := range conns {
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
+		c.Close()
+	}
+}
+
+// Close stops accepting new connections and tears down every connection
+// the link has relayed so far, along with their pipe goroutines.
+func (f *faultyLink) Close() {
+	f.listener.Close()
+
+	f.mutex.Lock()
+	conns := f.conns
+	f.conns = nil
+	f.mutex.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// ChaosHarness wraps a ReplicaSetHarness with a faultyLink in front of the
+// primary, so integration tests can exercise dvara against a programmable,
+// deterministic set of upstream faults instead of depending on real
+// network flakiness. A scenario runs a workload (such as the parallel
+// unique-index inserter in TestParallelInsertWithUniqueIndex) while firing
+// faults against Link, then asserts no writes were lost or duplicated and
+// that the proxy goes on serving cleanly afterwards.
+type ChaosHarness struct {
+	*ReplicaSetHarness
+	Link *faultyLink
+}
+
+// NewChaosHarness starts an n member replica set and a Proxy whose
+// upstream connection to the primary runs through a faultyLink, so a
+// script can call the link's fault-injection methods while a workload
+// runs concurrently against h.ProxySession().
+func NewChaosHarness(n int, tb testing.TB) *ChaosHarness {
+	h := newReplicaSetMembers(n, tb)
+	link := newFaultyLink(tb, h.addrs[0])
+	h.startProxy(link.Addr())
+	return &ChaosHarness{ReplicaSetHarness: h, Link: link}
+}
+
+// Stop tears down the faulty link in front of the primary in addition to
+// everything ReplicaSetHarness.Stop tears down.
+func (h *ChaosHarness) Stop() {
+	h.Link.Close()
+	h.ReplicaSetHarness.Stop()
+}
+
+// ProxyFor starts a second Proxy, fronted by its own faultyLink, in front
+// of replica set member i, so a scenario can target a specific secondary
+// independently of the harness's main proxy on the primary. The caller is
+// responsible for calling Stop on the returned proxy.
+func (h *ChaosHarness) ProxyFor(tb testing.TB, i int) (*Proxy, *faultyLink) {
+	link := newFaultyLink(tb, h.addrs[i])
+	proxy := &Proxy{ReplicaSet: &ReplicaSet{Addr: link.Addr(), MaxConnections: 10}}
+	if err := proxy.Start(); err != nil {
+		fatalf(tb, "could not start proxy for member %d: %s", i, err)
+	}
+	return proxy, link
+}
+
+// StepDownPrimary asks the real primary to step down, dialing it directly
+// and bypassing both the proxy and the faulty link, so a scenario can
+// exercise a genuine failover while the proxy's own connection is left
+// pointed at a now-stale primary.
+func (h *ChaosHarness) StepDownPrimary() error {
+	session, err := mgo.DialWithTimeout(h.addrs[0], 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return session.Run(mgobson.M{"replSetStepDown": 10, "force": true}, nil)
+}
@@ -0,0 +1,179 @@
+// +build integration
+
+package dvara
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+
+	mgobson "gopkg.in/mgo.v2/bson"
+)
+
+// TestChaosPrimaryStepDownDuringOpMsgStream fires a stream of
+// unacknowledged OP_MSG writes (moreToCome set on every one of them) and
+// steps the primary down mid-stream. It asserts that documents from the
+// stream survive the failover, that none of them carries an _id outside the
+// stream's range, and that the proxy keeps serving a fresh acknowledged
+// session afterwards.
+func TestChaosPrimaryStepDownDuringOpMsgStream(t *testing.T) {
+	h := NewChaosHarness(3, t)
+	defer h.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().
+		ApplyURI("mongodb://"+h.proxy.Addr()).
+		SetWriteConcern(writeconcern.Unacknowledged()))
+	ensure.Nil(t, err)
+	defer client.Disconnect(ctx)
+
+	collection := client.Database("test").Collection("chaos")
+
+	const total = 2000
+	go func() {
+		for i := 0; i < total; i++ {
+			collection.InsertOne(ctx, bson.M{"_id": i})
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if err := h.StepDownPrimary(); err != nil {
+		t.Logf("stepdown returned (expected during failover): %s", err)
+	}
+
+	// Give the stream time to finish draining into whichever member is
+	// primary once the election settles.
+	deadline := time.Now().Add(45 * time.Second)
+	var ids map[int64]bool
+	for time.Now().Before(deadline) {
+		ids = distinctIDs(t, ctx, collection)
+		if len(ids) > 0 {
+			// Keep polling a little longer in case the stream is still
+			// trickling in, then settle on the final count.
+			time.Sleep(2 * time.Second)
+			ids = distinctIDs(t, ctx, collection)
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	if len(ids) == 0 {
+		t.Fatal("no documents survived the failover at all")
+	}
+	for id := range ids {
+		if id < 0 || id >= total {
+			t.Fatalf("unexpected document id %d", id)
+		}
+	}
+
+	// The proxy must still be usable for ordinary acknowledged traffic
+	// after the failover.
+	verify, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+h.proxy.Addr()))
+	ensure.Nil(t, err)
+	defer verify.Disconnect(ctx)
+	_, err = verify.Database("test").Collection("chaos").InsertOne(ctx, bson.M{"_id": "after-failover"})
+	ensure.Nil(t, err)
+}
+
+func distinctIDs(t *testing.T, ctx context.Context, collection *mongo.Collection) map[int64]bool {
+	t.Helper()
+	cursor, err := collection.Find(ctx, bson.M{})
+	ensure.Nil(t, err)
+	defer cursor.Close(ctx)
+
+	ids := make(map[int64]bool)
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			continue
+		}
+		if id, ok := doc["_id"].(int32); ok {
+			ids[int64(id)] = true
+		}
+	}
+	return ids
+}
+
+// TestChaosUpstreamResetDuringGetMore opens a cursor with a small batch
+// size, resets every upstream connection mid-iteration the way an RST
+// from a crashed mongod would, and asserts a fresh session through the
+// same proxy can still read back every document afterwards.
+func TestChaosUpstreamResetDuringGetMore(t *testing.T) {
+	h := NewChaosHarness(1, t)
+	defer h.Stop()
+
+	session := h.ProxySession()
+	defer session.Close()
+	collection := session.DB("test").C("chaos")
+
+	const total = 500
+	for i := 0; i < total; i++ {
+		ensure.Nil(t, collection.Insert(mgobson.M{"_id": i}))
+	}
+
+	iter := collection.Find(nil).Batch(10).Iter()
+	var doc mgobson.M
+	seen := 0
+	for iter.Next(&doc) {
+		seen++
+		if seen == 20 {
+			h.Link.Reset()
+		}
+	}
+	// The in-flight cursor is allowed to fail once its upstream socket is
+	// reset; what matters is that the proxy recovers for later use.
+	_ = iter.Close()
+
+	deadline := time.Now().Add(15 * time.Second)
+	var n int
+	var err error
+	for time.Now().Before(deadline) {
+		retry := h.ProxySession()
+		n, err = retry.DB("test").C("chaos").Count()
+		retry.Close()
+		if err == nil && n == total {
+			return
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+	t.Fatalf("expected %d documents after reconnect, got %d (err=%v)", total, n, err)
+}
+
+// TestChaosSecondaryStall stalls the link in front of a secondary for 30
+// seconds while the client keeps reading from the primary through the
+// main proxy, and asserts the stalled secondary doesn't hold up traffic
+// that never touches it.
+func TestChaosSecondaryStall(t *testing.T) {
+	h := NewChaosHarness(2, t)
+	defer h.Stop()
+
+	secondaryProxy, secondaryLink := h.ProxyFor(t, 1)
+	defer secondaryProxy.Stop()
+	defer secondaryLink.Close()
+	secondaryLink.SetLatency(30 * time.Second)
+
+	session := h.ProxySession()
+	defer session.Close()
+	collection := session.DB("test").C("chaos")
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		ensure.Nil(t, collection.Insert(mgobson.M{"_id": i}))
+	}
+	n, err := collection.Count()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, n, 20)
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("primary traffic took %s, the stalled secondary link should not have blocked it", elapsed)
+	}
+}
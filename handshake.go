@@ -0,0 +1,142 @@
+package dvara
+
+import (
+	"net"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// dvaraVersion identifies this build of dvara in the proxy tag it adds to
+// every isMaster/hello handshake it relays.
+const dvaraVersion = "0.1.0"
+
+// appNameSuffix is appended to a client's application.name when the
+// ReplicaSet has AppendAppName set, so DBAs can tell proxied traffic apart
+// in $currentOp and the server log.
+const appNameSuffix = " (via dvara)"
+
+// isHandshake reports whether name is a command clients use to negotiate a
+// connection's wire version and capabilities, carrying the client metadata
+// document dvara taps into here.
+func isHandshake(name string) bool {
+	switch name {
+	case "isMaster", "ismaster", "hello":
+		return true
+	}
+	return false
+}
+
+// rewriteHandshake tags the "client" metadata document of an isMaster/hello
+// command with dvara's own identity before it is relayed upstream, so the
+// real client isn't hidden behind the proxy's own connection in
+// $currentOp and the server log. When appendAppName is set, it also
+// appends appNameSuffix to client.application.name.
+func rewriteHandshake(msg *OpMsgMessage, clientAddr net.Addr, appendAppName bool) error {
+	body, rewritten, err := rewriteHandshakeBody(msg.Body, clientAddr, appendAppName)
+	if err != nil || !rewritten {
+		return err
+	}
+	msg.Body = body
+	return nil
+}
+
+// rewriteLegacyHandshake does the same as rewriteHandshake, for an
+// isMaster/hello sent via the legacy OP_QUERY command protocol instead of
+// OP_MSG.
+func rewriteLegacyHandshake(msg *legacyQueryMessage, clientAddr net.Addr, appendAppName bool) error {
+	query, rewritten, err := rewriteHandshakeBody(msg.Query, clientAddr, appendAppName)
+	if err != nil || !rewritten {
+		return err
+	}
+	msg.Query = query
+	return nil
+}
+
+// rewriteHandshakeBody tags the "client" metadata document nested in body,
+// an isMaster/hello command document however it arrived, with dvara's own
+// identity, appending appNameSuffix to client.application.name when
+// appendAppName is set. It reports the rewritten document and whether a
+// "client" field was found to rewrite at all.
+func rewriteHandshakeBody(body bson.Raw, clientAddr net.Addr, appendAppName bool) (bson.Raw, bool, error) {
+	var doc bson.D
+	if err := body.Unmarshal(&doc); err != nil {
+		return bson.Raw{}, false, err
+	}
+
+	rewritten := false
+	for i, elem := range doc {
+		if elem.Name != "client" {
+			continue
+		}
+
+		client, err := asDocument(elem.Value)
+		if err != nil {
+			return bson.Raw{}, false, err
+		}
+
+		if appendAppName {
+			appendToApplicationName(client, appNameSuffix)
+		}
+		client = append(client, bson.DocElem{
+			Name: "proxy",
+			Value: bson.D{
+				{Name: "name", Value: "dvara"},
+				{Name: "version", Value: dvaraVersion},
+				{Name: "clientAddr", Value: clientAddr.String()},
+			},
+		})
+
+		doc[i].Value = client
+		rewritten = true
+	}
+	if !rewritten {
+		return body, false, nil
+	}
+
+	out, err := bson.Marshal(doc)
+	if err != nil {
+		return bson.Raw{}, false, err
+	}
+	return bson.Raw{Kind: 0x03, Data: out}, true, nil
+}
+
+// asDocument normalizes a bson element's value into a bson.D it can be
+// added to; bson.Unmarshal hands nested documents back as bson.Raw.
+func asDocument(v interface{}) (bson.D, error) {
+	switch t := v.(type) {
+	case bson.D:
+		return t, nil
+	case bson.Raw:
+		var d bson.D
+		if len(t.Data) == 0 {
+			return d, nil
+		}
+		if err := t.Unmarshal(&d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	default:
+		return bson.D{}, nil
+	}
+}
+
+// appendToApplicationName finds application.name within client and
+// appends suffix to it, if present.
+func appendToApplicationName(client bson.D, suffix string) {
+	for i, elem := range client {
+		if elem.Name != "application" {
+			continue
+		}
+		app, err := asDocument(elem.Value)
+		if err != nil {
+			return
+		}
+		for j, appElem := range app {
+			if name, ok := appElem.Value.(string); ok && appElem.Name == "name" {
+				app[j].Value = name + suffix
+			}
+		}
+		client[i].Value = app
+		return
+	}
+}
@@ -0,0 +1,168 @@
+// +build integration
+
+package dvara
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// ReplicaSetHarness starts a real N member mongod replica set on the local
+// machine and a Proxy in front of its primary, so integration tests can be
+// run against both the proxy and the real thing side by side.
+type ReplicaSetHarness struct {
+	T testing.TB
+
+	dir     string
+	members []*exec.Cmd
+	addrs   []string
+
+	proxy *Proxy
+}
+
+// NewReplicaSetHarness starts n mongod processes configured as a replica
+// set and initiates it. tb may be nil; when non-nil it is used for
+// t.Fatal-style reporting while starting up.
+func NewReplicaSetHarness(n int, tb testing.TB) *ReplicaSetHarness {
+	h := newReplicaSetMembers(n, tb)
+	h.startProxy(h.addrs[0])
+	return h
+}
+
+// newReplicaSetMembers starts n mongod processes configured as a replica
+// set and initiates it, without starting a Proxy in front of any member
+// yet. Used by NewReplicaSetHarness directly, and by ChaosHarness, which
+// wants to interpose its own fault-injecting link before the proxy dials
+// out.
+func newReplicaSetMembers(n int, tb testing.TB) *ReplicaSetHarness {
+	dir, err := ioutil.TempDir("", "dvara-harness")
+	if err != nil {
+		fatalf(tb, "could not create temp dir: %s", err)
+	}
+
+	h := &ReplicaSetHarness{T: tb, dir: dir}
+	for i := 0; i < n; i++ {
+		addr, cmd := h.startMember(i)
+		h.addrs = append(h.addrs, addr)
+		h.members = append(h.members, cmd)
+	}
+	h.initiate()
+	return h
+}
+
+// startProxy starts this harness's Proxy in front of addr.
+func (h *ReplicaSetHarness) startProxy(addr string) {
+	h.proxy = &Proxy{
+		ReplicaSet: &ReplicaSet{
+			Addr:           addr,
+			MaxConnections: 10,
+		},
+	}
+	if err := h.proxy.Start(); err != nil {
+		fatalf(h.T, "could not start proxy: %s", err)
+	}
+}
+
+func (h *ReplicaSetHarness) startMember(i int) (string, *exec.Cmd) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fatalf(h.T, "could not reserve port: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	dbPath := fmt.Sprintf("%s/member-%d", h.dir, i)
+	if err := os.MkdirAll(dbPath, 0755); err != nil {
+		fatalf(h.T, "could not create dbpath: %s", err)
+	}
+
+	_, port, _ := net.SplitHostPort(addr)
+	cmd := exec.Command(
+		"mongod",
+		"--replSet", "dvara-harness",
+		"--port", port,
+		"--dbpath", dbPath,
+		"--bind_ip", "127.0.0.1",
+		"--nojournal",
+		"--quiet",
+	)
+	if err := cmd.Start(); err != nil {
+		fatalf(h.T, "could not start mongod: %s", err)
+	}
+	return addr, cmd
+}
+
+func (h *ReplicaSetHarness) initiate() {
+	session, err := mgo.DialWithTimeout(h.addrs[0], 10*time.Second)
+	if err != nil {
+		fatalf(h.T, "could not dial first member: %s", err)
+	}
+	defer session.Close()
+
+	members := make([]map[string]interface{}, len(h.addrs))
+	for i, addr := range h.addrs {
+		members[i] = map[string]interface{}{"_id": i, "host": addr}
+	}
+	cfg := map[string]interface{}{
+		"_id":     "dvara-harness",
+		"members": members,
+	}
+	session.Run(map[string]interface{}{"replSetInitiate": cfg}, nil)
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := session.Ping(); err == nil {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	fatalf(h.T, "replica set never became healthy")
+}
+
+// ProxySession dials a new mgo session through the dvara proxy.
+func (h *ReplicaSetHarness) ProxySession() *mgo.Session {
+	session, err := mgo.Dial(h.proxy.Addr())
+	if err != nil {
+		fatalf(h.T, "could not dial proxy: %s", err)
+	}
+	return session
+}
+
+// RealSession dials a new mgo session directly against the primary,
+// bypassing the proxy.
+func (h *ReplicaSetHarness) RealSession() *mgo.Session {
+	session, err := mgo.Dial(h.addrs[0])
+	if err != nil {
+		fatalf(h.T, "could not dial primary: %s", err)
+	}
+	return session
+}
+
+// Stop tears down the proxy and every mongod member.
+func (h *ReplicaSetHarness) Stop() {
+	if h.proxy != nil {
+		h.proxy.Stop()
+	}
+	for _, cmd := range h.members {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}
+	os.RemoveAll(h.dir)
+}
+
+func fatalf(tb testing.TB, format string, args ...interface{}) {
+	if tb != nil {
+		tb.Fatalf(format, args...)
+		return
+	}
+	panic(fmt.Sprintf(format, args...))
+}
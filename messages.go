@@ -0,0 +1,430 @@
+package dvara
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MongoDB wire protocol opcodes. See
+// https://docs.mongodb.com/manual/reference/mongodb-wire-protocol/
+const (
+	OpReply       = 1
+	OpUpdate      = 2001
+	OpInsert      = 2002
+	OpQuery       = 2004
+	OpGetMore     = 2005
+	OpDelete      = 2006
+	OpKillCursors = 2007
+	OpMsg         = 2013
+)
+
+// OP_MSG flag bits.
+const (
+	flagChecksumPresent uint32 = 1 << 0
+	flagMoreToCome      uint32 = 1 << 1
+	flagExhaustAllowed  uint32 = 1 << 16
+)
+
+// OP_MSG section kinds.
+const (
+	sectionKindBody             = 0
+	sectionKindDocumentSequence = 1
+)
+
+// maxMessageSizeBytes bounds how large a single wire protocol message dvara
+// will allocate for, mirroring mongod's own default maxMessageSizeBytes. A
+// client is free to send a MessageLength of anything up to MaxInt32, and
+// that field must be trusted before the rest of the message has even been
+// read, so without a cap a single client could force an allocation of
+// nearly 2GB per message.
+const maxMessageSizeBytes = 48 * 1024 * 1024
+
+var errMsgTooShort = errors.New("dvara: OP_MSG message shorter than its header")
+var errMsgTooLarge = errors.New("dvara: message exceeds maxMessageSizeBytes")
+
+// MsgHeader is the mongo wire protocol message header, common to every
+// opcode.
+type MsgHeader struct {
+	MessageLength int32
+	RequestID     int32
+	ResponseTo    int32
+	OpCode        int32
+}
+
+const msgHeaderLen = 16
+
+func readMsgHeader(r io.Reader) (MsgHeader, error) {
+	var raw [msgHeaderLen]byte
+	if _, err := io.ReadFull(r, raw[:]); err != nil {
+		return MsgHeader{}, err
+	}
+	return MsgHeader{
+		MessageLength: int32(binary.LittleEndian.Uint32(raw[0:4])),
+		RequestID:     int32(binary.LittleEndian.Uint32(raw[4:8])),
+		ResponseTo:    int32(binary.LittleEndian.Uint32(raw[8:12])),
+		OpCode:        int32(binary.LittleEndian.Uint32(raw[12:16])),
+	}, nil
+}
+
+func (h MsgHeader) writeTo(w io.Writer) error {
+	var raw [msgHeaderLen]byte
+	binary.LittleEndian.PutUint32(raw[0:4], uint32(h.MessageLength))
+	binary.LittleEndian.PutUint32(raw[4:8], uint32(h.RequestID))
+	binary.LittleEndian.PutUint32(raw[8:12], uint32(h.ResponseTo))
+	binary.LittleEndian.PutUint32(raw[12:16], uint32(h.OpCode))
+	_, err := w.Write(raw[:])
+	return err
+}
+
+// DocumentSequence is an OP_MSG section of kind 1: a named, ordered run of
+// BSON documents that logically belong to the command body (for example the
+// "documents" sequence of an insert, or "deletes"/"updates").
+type DocumentSequence struct {
+	Identifier string
+	Documents  []bson.Raw
+}
+
+// OpMsgMessage is a fully decoded OP_MSG message.
+type OpMsgMessage struct {
+	Header MsgHeader
+
+	ChecksumPresent bool
+	MoreToCome      bool
+	ExhaustAllowed  bool
+
+	// Body is the kind 0 section, always present exactly once.
+	Body bson.Raw
+
+	// Sequences holds any kind 1 sections in the order they appeared, each
+	// carrying its identifier (e.g. "documents", "updates", "deletes").
+	Sequences []DocumentSequence
+
+	checksum uint32
+}
+
+// CommandName returns the name of the command this message carries, which
+// by convention is the first element of the body document.
+func (m *OpMsgMessage) CommandName() string {
+	var raw bson.RawD
+	if err := m.Body.Unmarshal(&raw); err != nil || len(raw) == 0 {
+		return ""
+	}
+	return raw[0].Name
+}
+
+// DB returns the value of the "$db" field carried in the body, if any.
+func (m *OpMsgMessage) DB() string {
+	var doc struct {
+		DB string `bson:"$db"`
+	}
+	if err := m.Body.Unmarshal(&doc); err != nil {
+		return ""
+	}
+	return doc.DB
+}
+
+// LSID returns the raw "lsid" document carried in the body, if any.
+func (m *OpMsgMessage) LSID() (bson.Raw, bool) {
+	var doc struct {
+		LSID bson.Raw `bson:"lsid"`
+	}
+	if err := m.Body.Unmarshal(&doc); err != nil || len(doc.LSID.Data) == 0 {
+		return bson.Raw{}, false
+	}
+	return doc.LSID, true
+}
+
+// readOpMsgMessage decodes an OP_MSG message body (everything following the
+// 16 byte header) from r.
+func readOpMsgMessage(h MsgHeader, r io.Reader) (*OpMsgMessage, error) {
+	remaining := int(h.MessageLength) - msgHeaderLen
+	if remaining < 4 {
+		return nil, errMsgTooShort
+	}
+	if remaining > maxMessageSizeBytes {
+		return nil, errMsgTooLarge
+	}
+	payload := make([]byte, remaining)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	flags := binary.LittleEndian.Uint32(payload[0:4])
+	m := &OpMsgMessage{
+		Header:          h,
+		ChecksumPresent: flags&flagChecksumPresent != 0,
+		MoreToCome:      flags&flagMoreToCome != 0,
+		ExhaustAllowed:  flags&flagExhaustAllowed != 0,
+	}
+
+	body := payload[4:]
+	if m.ChecksumPresent {
+		if len(body) < 4 {
+			return nil, errMsgTooShort
+		}
+		crcOffset := len(body) - 4
+		m.checksum = binary.LittleEndian.Uint32(body[crcOffset:])
+		body = body[:crcOffset]
+	}
+
+	haveBody := false
+	for len(body) > 0 {
+		kind := body[0]
+		body = body[1:]
+		switch kind {
+		case sectionKindBody:
+			raw, rest, err := takeDocument(body)
+			if err != nil {
+				return nil, err
+			}
+			m.Body = raw
+			haveBody = true
+			body = rest
+		case sectionKindDocumentSequence:
+			if len(body) < 4 {
+				return nil, errMsgTooShort
+			}
+			size := int(binary.LittleEndian.Uint32(body[0:4]))
+			if size < 4 || size > len(body) {
+				return nil, errMsgTooShort
+			}
+			section := body[4:size]
+			body = body[size:]
+
+			nul := indexByte(section, 0)
+			if nul < 0 {
+				return nil, errMsgTooShort
+			}
+			seq := DocumentSequence{Identifier: string(section[:nul])}
+			docs := section[nul+1:]
+			for len(docs) > 0 {
+				raw, rest, err := takeDocument(docs)
+				if err != nil {
+					return nil, err
+				}
+				seq.Documents = append(seq.Documents, raw)
+				docs = rest
+			}
+			m.Sequences = append(m.Sequences, seq)
+		default:
+			return nil, fmt.Errorf("dvara: unknown OP_MSG section kind %d", kind)
+		}
+	}
+	if !haveBody {
+		return nil, errors.New("dvara: OP_MSG missing kind 0 body section")
+	}
+	return m, nil
+}
+
+// takeDocument reads a single BSON document off the front of b, returning it
+// along with whatever follows.
+func takeDocument(b []byte) (bson.Raw, []byte, error) {
+	if len(b) < 4 {
+		return bson.Raw{}, nil, errMsgTooShort
+	}
+	size := int(binary.LittleEndian.Uint32(b[0:4]))
+	if size < 4 || size > len(b) {
+		return bson.Raw{}, nil, errMsgTooShort
+	}
+	return bson.Raw{Kind: 0x03, Data: b[:size]}, b[size:], nil
+}
+
+func indexByte(b []byte, c byte) int {
+	for i, v := range b {
+		if v == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// legacyQueryMessage is a decoded OP_QUERY message. dvara only needs to
+// look inside these for the "$cmd" pseudo-collection commands it cares
+// about (the isMaster/hello handshake); everything else is relayed with
+// Query and ReturnFieldsSelector left untouched.
+type legacyQueryMessage struct {
+	Header MsgHeader
+
+	Flags                int32
+	FullCollectionName   string
+	NumberToSkip         int32
+	NumberToReturn       int32
+	Query                bson.Raw
+	ReturnFieldsSelector bson.Raw // Data is nil when absent
+}
+
+// CommandName returns the name of the command this query carries, which by
+// convention is the first element of the query document. Only meaningful
+// when FullCollectionName is a "$cmd" pseudo-collection.
+func (m *legacyQueryMessage) CommandName() string {
+	var raw bson.RawD
+	if err := m.Query.Unmarshal(&raw); err != nil || len(raw) == 0 {
+		return ""
+	}
+	return raw[0].Name
+}
+
+// isCommandCollection reports whether name is the synthetic "$cmd"
+// collection drivers target to send a command over the legacy query
+// protocol, e.g. "admin.$cmd".
+func isCommandCollection(name string) bool {
+	const suffix = ".$cmd"
+	return len(name) > len(suffix) && name[len(name)-len(suffix):] == suffix
+}
+
+// readLegacyQueryMessage decodes an OP_QUERY message body (everything
+// following the 16 byte header) from r.
+func readLegacyQueryMessage(h MsgHeader, r io.Reader) (*legacyQueryMessage, error) {
+	remaining := int(h.MessageLength) - msgHeaderLen
+	if remaining < 4 {
+		return nil, errMsgTooShort
+	}
+	if remaining > maxMessageSizeBytes {
+		return nil, errMsgTooLarge
+	}
+	payload := make([]byte, remaining)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	m := &legacyQueryMessage{
+		Header: h,
+		Flags:  int32(binary.LittleEndian.Uint32(payload[0:4])),
+	}
+	body := payload[4:]
+
+	nul := indexByte(body, 0)
+	if nul < 0 {
+		return nil, errMsgTooShort
+	}
+	m.FullCollectionName = string(body[:nul])
+	body = body[nul+1:]
+
+	if len(body) < 8 {
+		return nil, errMsgTooShort
+	}
+	m.NumberToSkip = int32(binary.LittleEndian.Uint32(body[0:4]))
+	m.NumberToReturn = int32(binary.LittleEndian.Uint32(body[4:8]))
+	body = body[8:]
+
+	query, body, err := takeDocument(body)
+	if err != nil {
+		return nil, err
+	}
+	m.Query = query
+
+	if len(body) > 0 {
+		selector, _, err := takeDocument(body)
+		if err != nil {
+			return nil, err
+		}
+		m.ReturnFieldsSelector = selector
+	}
+
+	return m, nil
+}
+
+// writeTo serializes m back onto w, recomputing the message length.
+func (m *legacyQueryMessage) writeTo(w io.Writer) error {
+	var payload []byte
+	payload = appendUint32(payload, uint32(m.Flags))
+	payload = append(payload, m.FullCollectionName...)
+	payload = append(payload, 0)
+	payload = appendUint32(payload, uint32(m.NumberToSkip))
+	payload = appendUint32(payload, uint32(m.NumberToReturn))
+	payload = append(payload, m.Query.Data...)
+	if len(m.ReturnFieldsSelector.Data) > 0 {
+		payload = append(payload, m.ReturnFieldsSelector.Data...)
+	}
+
+	h := MsgHeader{
+		MessageLength: int32(msgHeaderLen + len(payload)),
+		RequestID:     m.Header.RequestID,
+		ResponseTo:    m.Header.ResponseTo,
+		OpCode:        OpQuery,
+	}
+	if err := h.writeTo(w); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// writeTo serializes m back onto w, recomputing the checksum when one was
+// present on the way in.
+func (m *OpMsgMessage) writeTo(w io.Writer) error {
+	var flags uint32
+	if m.MoreToCome {
+		flags |= flagMoreToCome
+	}
+	if m.ExhaustAllowed {
+		flags |= flagExhaustAllowed
+	}
+	if m.ChecksumPresent {
+		flags |= flagChecksumPresent
+	}
+
+	var payload []byte
+	payload = appendUint32(payload, flags)
+
+	payload = append(payload, sectionKindBody)
+	payload = append(payload, m.Body.Data...)
+
+	for _, seq := range m.Sequences {
+		payload = append(payload, sectionKindDocumentSequence)
+		sizeOffset := len(payload)
+		payload = appendUint32(payload, 0)
+		payload = append(payload, seq.Identifier...)
+		payload = append(payload, 0)
+		for _, doc := range seq.Documents {
+			payload = append(payload, doc.Data...)
+		}
+		binary.LittleEndian.PutUint32(payload[sizeOffset:sizeOffset+4], uint32(len(payload)-sizeOffset))
+	}
+
+	if m.ChecksumPresent {
+		h := MsgHeader{
+			MessageLength: int32(msgHeaderLen + len(payload) + 4),
+			RequestID:     m.Header.RequestID,
+			ResponseTo:    m.Header.ResponseTo,
+			OpCode:        OpMsg,
+		}
+		// The CRC covers the whole message as it goes on the wire, header
+		// included, up to but excluding the checksum field itself.
+		var headerBuf bytes.Buffer
+		if err := h.writeTo(&headerBuf); err != nil {
+			return err
+		}
+		crc := crc32.Checksum(append(headerBuf.Bytes(), payload...), crc32.MakeTable(crc32.Castagnoli))
+		payload = appendUint32(payload, crc)
+		if _, err := w.Write(headerBuf.Bytes()); err != nil {
+			return err
+		}
+		_, err := w.Write(payload)
+		return err
+	}
+
+	h := MsgHeader{
+		MessageLength: int32(msgHeaderLen + len(payload)),
+		RequestID:     m.Header.RequestID,
+		ResponseTo:    m.Header.ResponseTo,
+		OpCode:        OpMsg,
+	}
+	if err := h.writeTo(w); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var raw [4]byte
+	binary.LittleEndian.PutUint32(raw[:], v)
+	return append(b, raw[:]...)
+}
@@ -0,0 +1,63 @@
+package dvara
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestOpMsgMessageChecksumRoundTrip verifies that a message written with
+// ChecksumPresent set carries a CRC32C a conforming receiver would accept:
+// computed over the whole wire message, header included, up to but
+// excluding the checksum field itself.
+func TestOpMsgMessageChecksumRoundTrip(t *testing.T) {
+	body, err := bson.Marshal(bson.D{{Name: "ping", Value: 1}})
+	ensure.Nil(t, err)
+
+	msg := &OpMsgMessage{
+		Header:          MsgHeader{RequestID: 42},
+		ChecksumPresent: true,
+		Body:            bson.Raw{Kind: 0x03, Data: body},
+	}
+
+	var buf bytes.Buffer
+	ensure.Nil(t, msg.writeTo(&buf))
+
+	wire := buf.Bytes()
+	crcOffset := len(wire) - 4
+	gotCRC := crc32.Checksum(wire[:crcOffset], crc32.MakeTable(crc32.Castagnoli))
+	wantCRC := binary.LittleEndian.Uint32(wire[crcOffset:])
+	ensure.DeepEqual(t, gotCRC, wantCRC)
+
+	r := bufio.NewReader(&buf)
+	header, err := readMsgHeader(r)
+	ensure.Nil(t, err)
+
+	decoded, err := readOpMsgMessage(header, r)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, decoded.ChecksumPresent, true)
+	ensure.DeepEqual(t, decoded.checksum, wantCRC)
+}
+
+// TestReadMessageRejectsOversizedMessageLength verifies that a header
+// claiming an implausibly large MessageLength is rejected before dvara
+// allocates a buffer for it, rather than trusting client-controlled input
+// to size an allocation.
+func TestReadMessageRejectsOversizedMessageLength(t *testing.T) {
+	oversized := MsgHeader{
+		MessageLength: int32(msgHeaderLen + maxMessageSizeBytes + 1),
+		OpCode:        OpMsg,
+	}
+	_, err := readOpMsgMessage(oversized, bytes.NewReader(nil))
+	ensure.DeepEqual(t, err, errMsgTooLarge)
+
+	oversized.OpCode = OpQuery
+	_, err = readLegacyQueryMessage(oversized, bytes.NewReader(nil))
+	ensure.DeepEqual(t, err, errMsgTooLarge)
+}
@@ -0,0 +1,344 @@
+package dvara
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// errZeroMaxConnections is returned by Proxy.Start when the backing
+// ReplicaSet has not been configured with a connection pool size.
+var errZeroMaxConnections = errors.New("dvara: MaxConnections cannot be 0")
+
+// Proxy accepts client connections for a single ReplicaSet member and
+// relays traffic to it, understanding enough of the wire protocol to route
+// and rewrite messages in flight.
+type Proxy struct {
+	ReplicaSet *ReplicaSet
+
+	mutex    sync.Mutex
+	listener net.Listener
+	closed   bool
+}
+
+// Start begins listening for client connections. It returns
+// errZeroMaxConnections if the ReplicaSet has not been given a pool size.
+func (p *Proxy) Start() error {
+	if p.ReplicaSet.MaxConnections == 0 {
+		return errZeroMaxConnections
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	p.listener = l
+	p.mutex.Unlock()
+
+	go p.acceptLoop()
+	return nil
+}
+
+// Addr returns the address the proxy is listening on, once Start has been
+// called successfully.
+func (p *Proxy) Addr() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.listener == nil {
+		return ""
+	}
+	return p.listener.Addr().String()
+}
+
+func (p *Proxy) acceptLoop() {
+	for {
+		c, err := p.listener.Accept()
+		if err != nil {
+			p.mutex.Lock()
+			closed := p.closed
+			p.mutex.Unlock()
+			if closed {
+				return
+			}
+			log.Printf("dvara: accept error: %s", err)
+			return
+		}
+		go p.clientServeLoop(c)
+	}
+}
+
+// clientServeLoop reads one wire protocol message at a time off the client
+// connection, dispatches it upstream and relays the reply, understanding
+// both the legacy opcodes and OP_MSG. An upstream connection is dialed as
+// soon as the client connects, before any message is read, and held for the
+// lifetime of the client connection.
+func (p *Proxy) clientServeLoop(client net.Conn) {
+	defer client.Close()
+
+	upstream, err := net.Dial("tcp", p.ReplicaSet.Addr)
+	if err != nil {
+		log.Printf("dvara: could not dial upstream %s: %s", p.ReplicaSet.Addr, err)
+		return
+	}
+
+	own := newPinnedUpstream(upstream)
+	tracker := newClientSessionTracker()
+
+	// own may have been shared with other client connections by session
+	// affinity, so it is only actually closed once every connection
+	// relying on it — including the borrowed upstreams below, which
+	// belong to other connections but were pinned by a session this one
+	// started — has gone away. Order matters: endClientSessions still
+	// needs own's connection open, so it must run before these releases.
+	defer own.release()
+	defer func() {
+		for _, borrowed := range tracker.borrowedUpstreams() {
+			borrowed.release()
+		}
+	}()
+	defer p.endClientSessions(tracker, own)
+
+	r := bufio.NewReader(client)
+	for {
+		header, err := readMsgHeader(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("dvara: error reading client header: %s", err)
+			}
+			return
+		}
+
+		switch header.OpCode {
+		case OpMsg:
+			if err := p.relayOpMsg(header, r, client, own, tracker); err != nil {
+				log.Printf("dvara: error relaying OP_MSG: %s", err)
+				return
+			}
+		default:
+			if err := p.relayLegacyMessage(header, r, client, own); err != nil {
+				log.Printf("dvara: error relaying legacy message: %s", err)
+				return
+			}
+		}
+	}
+}
+
+// relayOpMsg decodes a client OP_MSG, forwards it upstream, and relays the
+// reply back. When the client set moreToCome, no reply is expected and none
+// is read; when the final reply from upstream itself sets moreToCome, dvara
+// keeps draining replies until the stream ends, without expecting the
+// client to ask for each one (used by getMore exhaust cursors).
+//
+// own is this client connection's own upstream connection. When the message
+// carries an lsid, the proxy instead dispatches on whichever upstream
+// connection is already pinned to that session (which may be own, or may
+// belong to a different client connection sharing the same logical
+// session), so own may end up serving traffic pinned there by someone else
+// too; either way every round trip runs under the target's mutex so the
+// wire protocol stream is never interleaved.
+func (p *Proxy) relayOpMsg(header MsgHeader, r io.Reader, client net.Conn, own *pinnedUpstream, tracker *clientSessionTracker) error {
+	msg, err := readOpMsgMessage(header, r)
+	if err != nil {
+		return err
+	}
+
+	firstSight := tracker.observe(msg)
+
+	if isHandshake(msg.CommandName()) {
+		if err := rewriteHandshake(msg, client.RemoteAddr(), p.ReplicaSet.AppendAppName); err != nil {
+			return err
+		}
+	}
+
+	target := own
+	if lsid, ok := msg.LSID(); ok {
+		if firstSight {
+			var created, expired bool
+			var generation uint64
+			target, created, generation, expired = p.ReplicaSet.Affinity.acquire(lsid, own)
+			tracker.recordSession(lsid, generation)
+			if expired {
+				p.ReplicaSet.Stats.sessionsClosed(1)
+			}
+			if created {
+				p.ReplicaSet.Stats.sessionOpened()
+			} else {
+				tracker.addBorrowed(target)
+			}
+		} else {
+			var expired bool
+			target, expired = p.ReplicaSet.Affinity.lookup(lsid, own)
+			if expired {
+				p.ReplicaSet.Stats.sessionsClosed(1)
+			}
+		}
+	}
+
+	return target.do(func(upstream net.Conn) error {
+		if err := msg.writeTo(upstream); err != nil {
+			return err
+		}
+
+		if msg.MoreToCome {
+			// A moreToCome request (e.g. an unacknowledged write) gets no
+			// reply at all, from the client's perspective.
+			return nil
+		}
+
+		return p.relayOpMsgReplies(upstream, client)
+	})
+}
+
+// relayOpMsgReplies copies one OP_MSG reply from upstream to client, and
+// keeps copying further ones for as long as upstream keeps setting
+// moreToCome without the client having to ask again (exhaust cursors).
+func (p *Proxy) relayOpMsgReplies(upstream, client net.Conn) error {
+	ur := bufio.NewReader(upstream)
+	for {
+		replyHeader, err := readMsgHeader(ur)
+		if err != nil {
+			return err
+		}
+		reply, err := readOpMsgMessage(replyHeader, ur)
+		if err != nil {
+			return err
+		}
+		if err := reply.writeTo(client); err != nil {
+			return err
+		}
+		if !reply.MoreToCome {
+			return nil
+		}
+	}
+}
+
+// endClientSessions runs when a client connection goes away. Every lsid the
+// tracker observed on that connection has one fewer connection relying on
+// it now; only the ones that drop to zero — meaning no other connection is
+// still using them, e.g. mid-transaction — are actually ended upstream via
+// a synthesized endSessions, so the server does not keep per-session state
+// around until its 30 minute idle timeout. own may be pinned and shared
+// with other client connections, so the command is sent through own.do
+// like any other dispatch, never written to the raw connection directly.
+//
+// If the send fails, dvara has already forgotten the session on its side
+// (see sessionAffinity.release) and simply falls back on mongod's own idle
+// timeout to clean it up, the same as it would if this feature didn't exist.
+func (p *Proxy) endClientSessions(tracker *clientSessionTracker, own *pinnedUpstream) {
+	sessions := tracker.sessionIDs()
+	if len(sessions) == 0 {
+		return
+	}
+
+	freed := p.ReplicaSet.Affinity.release(sessions)
+	if len(freed) == 0 {
+		return
+	}
+
+	cmd := bson.D{{Name: "endSessions", Value: freed}}
+	err := own.do(func(upstream net.Conn) error {
+		return sendAdminCommand(upstream, cmd)
+	})
+	if err != nil {
+		log.Printf("dvara: error ending sessions: %s", err)
+		p.ReplicaSet.Stats.killFailed()
+		return
+	}
+	p.ReplicaSet.Stats.sessionsClosed(int64(len(freed)))
+}
+
+// relayLegacyMessage relays an OP_QUERY/OP_INSERT/OP_UPDATE/OP_DELETE/
+// OP_GET_MORE/OP_KILL_CURSORS message, reading the matching OP_REPLY back
+// when the opcode expects one. OP_QUERY is decoded rather than copied
+// verbatim: every driver, even an OP_MSG-capable one, always sends the very
+// first isMaster/hello handshake on a brand new connection this way, since
+// it can't know the server's wire version — and therefore whether OP_MSG is
+// safe to use — before that first reply comes back.
+//
+// own is this client connection's own upstream connection. Like relayOpMsg,
+// the dispatch runs under own.do so it can never interleave on the wire
+// with traffic session affinity has pinned there on behalf of some other
+// client connection sharing the same lsid.
+func (p *Proxy) relayLegacyMessage(header MsgHeader, r io.Reader, client net.Conn, own *pinnedUpstream) error {
+	if header.OpCode == OpQuery {
+		return p.relayLegacyQuery(header, r, client, own)
+	}
+
+	remaining := int64(header.MessageLength) - msgHeaderLen
+	return own.do(func(upstream net.Conn) error {
+		if err := header.writeTo(upstream); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(upstream, r, remaining); err != nil {
+			return err
+		}
+
+		if header.OpCode == OpInsert || header.OpCode == OpUpdate ||
+			header.OpCode == OpDelete || header.OpCode == OpKillCursors {
+			// These opcodes never get a reply.
+			return nil
+		}
+
+		return relayLegacyReply(upstream, client)
+	})
+}
+
+// relayLegacyQuery decodes a client OP_QUERY and, when it is an
+// isMaster/hello handshake sent against the "$cmd" pseudo-collection, tags
+// its client metadata the same way relayOpMsg does before relaying it
+// upstream. Any other OP_QUERY (ordinary traffic from a pre-3.6 driver) is
+// forwarded with its contents unchanged. Runs under own.do for the same
+// reason relayLegacyMessage does.
+func (p *Proxy) relayLegacyQuery(header MsgHeader, r io.Reader, client net.Conn, own *pinnedUpstream) error {
+	msg, err := readLegacyQueryMessage(header, r)
+	if err != nil {
+		return err
+	}
+
+	if isCommandCollection(msg.FullCollectionName) && isHandshake(msg.CommandName()) {
+		if err := rewriteLegacyHandshake(msg, client.RemoteAddr(), p.ReplicaSet.AppendAppName); err != nil {
+			return err
+		}
+	}
+
+	return own.do(func(upstream net.Conn) error {
+		if err := msg.writeTo(upstream); err != nil {
+			return err
+		}
+		return relayLegacyReply(upstream, client)
+	})
+}
+
+// relayLegacyReply copies a single OP_REPLY from upstream to client.
+func relayLegacyReply(upstream, client net.Conn) error {
+	ur := bufio.NewReader(upstream)
+	replyHeader, err := readMsgHeader(ur)
+	if err != nil {
+		return err
+	}
+	if err := replyHeader.writeTo(client); err != nil {
+		return err
+	}
+	_, err = io.CopyN(client, ur, int64(replyHeader.MessageLength)-msgHeaderLen)
+	return err
+}
+
+// Stop closes the listener, preventing further connections from being
+// accepted. Connections already being served are left to finish on their
+// own.
+func (p *Proxy) Stop() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Close()
+}
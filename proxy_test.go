@@ -3,13 +3,24 @@
 package dvara
 
 import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/facebookgo/ensure"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
 	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	mgobson "gopkg.in/mgo.v2/bson"
 )
 
 var harness *ReplicaSetHarness
@@ -51,7 +62,7 @@ func inserter(s *mgo.Session, channel chan int, limit int) {
 	c := s.DB("test").C("test")
 	c.EnsureIndex(mgo.Index{Key: []string{"phoneNum"}, Unique: true})
 	for i := 1; i <= limit; i++ {
-		if err := c.Insert(bson.M{"phoneNum": i}); err == nil {
+		if err := c.Insert(mgobson.M{"phoneNum": i}); err == nil {
 			channel <- i
 		}
 	}
@@ -77,7 +88,7 @@ func TestSimpleCRUD(t *testing.T) {
 			t.Fatalf("expecting 1 got %d", n)
 		}
 		result := make(map[string]interface{})
-		collection.Find(bson.M{"_id": 1}).One(&result)
+		collection.Find(mgobson.M{"_id": 1}).One(&result)
 		if result["name"] != "abc" {
 			t.Fatal("expecting name abc got", result)
 		}
@@ -195,18 +206,18 @@ func TestRemoval(t *testing.T) {
 		session := harness.ProxySession()
 		defer session.Close()
 		collection := session.DB("test").C("testremoval")
-		if err := collection.Insert(bson.M{"S": "hello", "I": 24}); err != nil {
+		if err := collection.Insert(mgobson.M{"S": "hello", "I": 24}); err != nil {
 			t.Fatal(err)
 		}
-		if err := collection.Remove(bson.M{"S": "hello", "I": 24}); err != nil {
+		if err := collection.Remove(mgobson.M{"S": "hello", "I": 24}); err != nil {
 			t.Fatal(err)
 		}
 		var res []interface{}
-		collection.Find(bson.M{"S": "hello", "I": 24}).All(&res)
+		collection.Find(mgobson.M{"S": "hello", "I": 24}).All(&res)
 		if res != nil {
 			t.Fatal("found object after delete", res)
 		}
-		if err := collection.Remove(bson.M{"S": "hello", "I": 24}); err == nil {
+		if err := collection.Remove(mgobson.M{"S": "hello", "I": 24}); err == nil {
 			t.Fatal("removing nonexistant document should error")
 		}
 	})
@@ -217,7 +228,7 @@ func TestUpdate(t *testing.T) {
 		session := harness.ProxySession()
 		defer session.Close()
 		collection := session.DB("test").C("testupdate")
-		if err := collection.Insert(bson.M{"_id": "1234", "name": "Alfred"}); err != nil {
+		if err := collection.Insert(mgobson.M{"_id": "1234", "name": "Alfred"}); err != nil {
 			t.Fatal(err)
 		}
 		var result map[string]interface{}
@@ -225,14 +236,14 @@ func TestUpdate(t *testing.T) {
 		if result["name"] != "Alfred" {
 			t.Fatal("insert failed")
 		}
-		if err := collection.Update(bson.M{"_id": "1234"}, bson.M{"name": "Jeeves"}); err != nil {
+		if err := collection.Update(mgobson.M{"_id": "1234"}, mgobson.M{"name": "Jeeves"}); err != nil {
 			t.Fatal("update failed with", err)
 		}
 		collection.Find(nil).One(&result)
 		if result["name"] != "Jeeves" {
 			t.Fatal("update failed")
 		}
-		if err := collection.Update(bson.M{"_id": "00000"}, bson.M{"name": "Jeeves"}); err == nil {
+		if err := collection.Update(mgobson.M{"_id": "00000"}, mgobson.M{"name": "Jeeves"}); err == nil {
 			t.Fatal("update failed")
 		}
 	})
@@ -249,7 +260,7 @@ func TestStopChattyClient(t *testing.T) {
 			for {
 				select {
 				default:
-					collection.Insert(bson.M{"value": i})
+					collection.Insert(mgobson.M{"value": i})
 					i++
 				case <-fin:
 					return
@@ -264,7 +275,7 @@ func TestStopIdleClient(t *testing.T) {
 	withHarness(t, func(harness *ReplicaSetHarness) {
 		session := harness.ProxySession()
 		defer session.Close()
-		if err := session.DB("test").C("col").Insert(bson.M{"v": 1}); err != nil {
+		if err := session.DB("test").C("col").Insert(mgobson.M{"v": 1}); err != nil {
 			t.Fatal(err)
 		}
 	})
@@ -284,8 +295,8 @@ func benchmarkInsertRead(b *testing.B, session *mgo.Session) {
 	defer session.Close()
 	col := session.DB("test").C("col")
 	col.EnsureIndex(mgo.Index{Key: []string{"answer"}, Unique: true})
-	insertDocs := bson.D{bson.DocElem{Name: "answer"}}
-	inserted := bson.M{}
+	insertDocs := mgobson.D{mgobson.DocElem{Name: "answer"}}
+	inserted := mgobson.M{}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		insertDocs[0].Value = i
@@ -310,3 +321,443 @@ func BenchmarkInsertReadDirect(b *testing.B) {
 	p := NewReplicaSetHarness(3, b)
 	benchmarkInsertRead(b, p.RealSession())
 }
+
+// TestOpMsgCRUD drives the proxy with go.mongodb.org/mongo-driver, which
+// speaks OP_MSG once its initial handshake is done, alongside the legacy
+// mgo-backed tests above to
+// prove dvara handles both kinds of client on the same harness.
+func TestOpMsgCRUD(t *testing.T) {
+	withHarness(t, func(harness *ReplicaSetHarness) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+harness.proxy.Addr()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Disconnect(ctx)
+
+		collection := client.Database("test").Collection("opmsg")
+		if _, err := collection.InsertOne(ctx, bson.M{"_id": 1, "name": "abc"}); err != nil {
+			t.Fatal("insertion error", err)
+		}
+
+		n, err := collection.CountDocuments(ctx, bson.M{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("expecting 1 got %d", n)
+		}
+
+		var result bson.M
+		if err := collection.FindOne(ctx, bson.M{"_id": 1}).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result["name"] != "abc" {
+			t.Fatal("expecting name abc got", result)
+		}
+
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": 1}, bson.M{"$set": bson.M{"name": "def"}}); err != nil {
+			t.Fatal("update failed with", err)
+		}
+		if _, err := collection.DeleteOne(ctx, bson.M{"_id": 1}); err != nil {
+			t.Fatal("delete failed with", err)
+		}
+	})
+}
+
+// TestMixedLegacyAndOpMsgClients opens a legacy mgo client and an OP_MSG
+// mongo-driver client against the same proxy at once, to prove dvara
+// doesn't require every connection to negotiate the same wire version.
+func TestMixedLegacyAndOpMsgClients(t *testing.T) {
+	withHarness(t, func(harness *ReplicaSetHarness) {
+		legacy := harness.ProxySession()
+		defer legacy.Close()
+		if err := legacy.DB("test").C("mixed").Insert(mgobson.M{"_id": 1}); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+harness.proxy.Addr()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Disconnect(ctx)
+
+		var result bson.M
+		if err := client.Database("test").Collection("mixed").FindOne(ctx, bson.M{"_id": 1}).Decode(&result); err != nil {
+			t.Fatal("OP_MSG client could not read document inserted by legacy client", err)
+		}
+	})
+}
+
+// TestSessionsReleasedOnDisconnect drives OP_MSG traffic carrying an lsid
+// over a raw connection, then closes it without sending endSessions, the
+// way a crashed client would. It asserts dvara notices the disconnect and
+// releases the session upstream itself rather than leaving it for the
+// server's 30 minute idle timeout — checking not just dvara's own counters
+// but, via $currentOp against the real primary, that the server agrees the
+// sessions are actually gone.
+func TestSessionsReleasedOnDisconnect(t *testing.T) {
+	withHarness(t, func(harness *ReplicaSetHarness) {
+		before := harness.proxy.ReplicaSet.Stats.SessionsEnded()
+
+		const sessions = 25
+		lsids := make([][]byte, 0, sessions)
+		for i := 0; i < sessions; i++ {
+			conn, err := net.Dial("tcp", harness.proxy.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id := randomUUID()
+			lsids = append(lsids, id)
+			body, err := mgobson.Marshal(mgobson.D{
+				{Name: "find", Value: "coll1"},
+				{Name: "$db", Value: "test"},
+				{Name: "lsid", Value: mgobson.D{{Name: "id", Value: mgobson.Binary{Kind: 0x04, Data: id}}}},
+			})
+			ensure.Nil(t, err)
+
+			msg := &OpMsgMessage{Body: mgobson.Raw{Kind: 0x03, Data: body}}
+			ensure.Nil(t, msg.writeTo(conn))
+
+			header, err := readMsgHeader(conn)
+			ensure.Nil(t, err)
+			_, err = readOpMsgMessage(header, conn)
+			ensure.Nil(t, err)
+
+			conn.Close()
+		}
+
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if harness.proxy.ReplicaSet.Stats.SessionsEnded()-before >= sessions {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		ensure.DeepEqual(t, harness.proxy.ReplicaSet.Stats.SessionsEnded()-before, int64(sessions))
+		ensure.DeepEqual(t, harness.proxy.ReplicaSet.Stats.KillFailures(), int64(0))
+
+		ensureNoLeftoverSessions(t, harness, lsids)
+	})
+}
+
+// ensureNoLeftoverSessions polls $currentOp on the real primary, bypassing
+// the proxy, until none of lsids are still reported as live sessions. This
+// closes the loop dvara's own Stats counters can't: a command mongod
+// silently rejected or no-op'd would still have bumped SessionsEnded.
+func ensureNoLeftoverSessions(t *testing.T, harness *ReplicaSetHarness, lsids [][]byte) {
+	t.Helper()
+	session := harness.RealSession()
+	defer session.Close()
+
+	want := make(map[string]bool, len(lsids))
+	for _, id := range lsids {
+		want[string(id)] = true
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		leftover := leftoverLSIDs(t, session, want)
+		if len(leftover) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d sessions still reported live by $currentOp", len(leftover), len(lsids))
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// leftoverLSIDs returns whichever of want are still reported as live
+// sessions by $currentOp.
+func leftoverLSIDs(t *testing.T, session *mgo.Session, want map[string]bool) map[string]bool {
+	t.Helper()
+	var result mgobson.M
+	err := session.DB("admin").Run(mgobson.D{
+		{Name: "aggregate", Value: 1},
+		{Name: "pipeline", Value: []mgobson.M{
+			{"$currentOp": mgobson.M{"allUsers": true, "idleSessions": true}},
+		}},
+		{Name: "cursor", Value: mgobson.M{}},
+	}, &result)
+	ensure.Nil(t, err)
+
+	leftover := make(map[string]bool)
+	cursor, ok := result["cursor"].(mgobson.M)
+	if !ok {
+		return leftover
+	}
+	batch, ok := cursor["firstBatch"].([]interface{})
+	if !ok {
+		return leftover
+	}
+	for _, e := range batch {
+		op, ok := e.(mgobson.M)
+		if !ok {
+			continue
+		}
+		lsidDoc, ok := op["lsid"].(mgobson.M)
+		if !ok {
+			continue
+		}
+		id, ok := lsidDoc["id"].(mgobson.Binary)
+		if !ok {
+			continue
+		}
+		if want[string(id.Data)] {
+			leftover[string(id.Data)] = true
+		}
+	}
+	return leftover
+}
+
+// TestSessionSurvivesPartialDisconnect drives two separate raw connections
+// through the proxy using the same lsid, then disconnects only one of
+// them. It asserts the shared session is not ended upstream until the
+// second, last connection relying on it disconnects too — otherwise the
+// first connection's still-active session (or transaction) would be
+// killed out from under it by an unrelated peer going away.
+func TestSessionSurvivesPartialDisconnect(t *testing.T) {
+	withHarness(t, func(harness *ReplicaSetHarness) {
+		before := harness.proxy.ReplicaSet.Stats.SessionsEnded()
+
+		lsid := mgobson.Binary{Kind: 0x04, Data: randomUUID()}
+		sendFind := func(conn net.Conn) {
+			body, err := mgobson.Marshal(mgobson.D{
+				{Name: "find", Value: "coll1"},
+				{Name: "$db", Value: "test"},
+				{Name: "lsid", Value: mgobson.D{{Name: "id", Value: lsid}}},
+			})
+			ensure.Nil(t, err)
+
+			msg := &OpMsgMessage{Body: mgobson.Raw{Kind: 0x03, Data: body}}
+			ensure.Nil(t, msg.writeTo(conn))
+
+			header, err := readMsgHeader(conn)
+			ensure.Nil(t, err)
+			_, err = readOpMsgMessage(header, conn)
+			ensure.Nil(t, err)
+		}
+
+		connA, err := net.Dial("tcp", harness.proxy.Addr())
+		ensure.Nil(t, err)
+		defer connA.Close()
+		sendFind(connA)
+
+		connB, err := net.Dial("tcp", harness.proxy.Addr())
+		ensure.Nil(t, err)
+		sendFind(connB)
+
+		connB.Close()
+
+		// Give dvara time to notice connB's disconnect and react, then
+		// confirm it didn't end the session connA still relies on.
+		time.Sleep(500 * time.Millisecond)
+		ensure.DeepEqual(t, harness.proxy.ReplicaSet.Stats.SessionsEnded(), before)
+
+		// connA must still be usable: its pinned upstream must not have
+		// been closed by connB going away.
+		sendFind(connA)
+		connA.Close()
+
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if harness.proxy.ReplicaSet.Stats.SessionsEnded() > before {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		ensure.DeepEqual(t, harness.proxy.ReplicaSet.Stats.SessionsEnded()-before, int64(1))
+	})
+}
+
+// TestTransactionAffinity drives two raw connections sharing one lsid
+// through the proxy and asserts that dvara's session affinity then holds a
+// live pin for that lsid — the single entry through which both connections'
+// commands for it are dispatched. A driver-level transaction would commit
+// successfully with or without this — mongod tracks transaction state by
+// lsid/txnNumber server-side, and a replica set primary continues a
+// transaction across different connections from the same client just fine
+// — so this drives the mechanism directly via sessionAffinity.lookup
+// instead, the same way TestSessionSurvivesPartialDisconnect checks
+// dvara's refcounting directly rather than through driver behavior.
+func TestTransactionAffinity(t *testing.T) {
+	withHarness(t, func(harness *ReplicaSetHarness) {
+		lsid := mgobson.Binary{Kind: 0x04, Data: randomUUID()}
+		sendFind := func(conn net.Conn) {
+			body, err := mgobson.Marshal(mgobson.D{
+				{Name: "find", Value: "coll1"},
+				{Name: "$db", Value: "test"},
+				{Name: "lsid", Value: mgobson.D{{Name: "id", Value: lsid}}},
+			})
+			ensure.Nil(t, err)
+
+			msg := &OpMsgMessage{Body: mgobson.Raw{Kind: 0x03, Data: body}}
+			ensure.Nil(t, msg.writeTo(conn))
+
+			header, err := readMsgHeader(conn)
+			ensure.Nil(t, err)
+			_, err = readOpMsgMessage(header, conn)
+			ensure.Nil(t, err)
+		}
+
+		connA, err := net.Dial("tcp", harness.proxy.Addr())
+		ensure.Nil(t, err)
+		defer connA.Close()
+		sendFind(connA)
+
+		connB, err := net.Dial("tcp", harness.proxy.Addr())
+		ensure.Nil(t, err)
+		defer connB.Close()
+		sendFind(connB)
+
+		lsidDoc, err := mgobson.Marshal(mgobson.D{{Name: "id", Value: lsid}})
+		ensure.Nil(t, err)
+		lsidRaw := mgobson.Raw{Kind: 0x03, Data: lsidDoc}
+
+		target, expired := harness.proxy.ReplicaSet.Affinity.lookup(lsidRaw, nil)
+		ensure.DeepEqual(t, expired, false)
+		if target == nil {
+			t.Fatal("lsid shared by connA and connB has no affinity entry")
+		}
+	})
+}
+
+// TestHandshakeMetadata verifies the isMaster/hello handshake dvara
+// forwards upstream carries the client's own metadata tagged with a
+// "proxy" field identifying dvara, and that application.name passes
+// through unsuffixed by default but gets dvara's suffix appended when the
+// upstream ReplicaSet has AppendAppName set.
+func TestHandshakeMetadata(t *testing.T) {
+	withHarness(t, func(harness *ReplicaSetHarness) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		appName := fmt.Sprintf("dvara-handshake-test-%d", time.Now().UnixNano())
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+harness.proxy.Addr()).SetAppName(appName))
+		ensure.Nil(t, err)
+		defer client.Disconnect(ctx)
+		ensure.Nil(t, client.Ping(ctx, nil))
+
+		meta := clientMetadataByAppName(t, harness, appName)
+		ensure.DeepEqual(t, meta["application"].(mgobson.M)["name"], appName)
+		ensure.DeepEqual(t, meta["proxy"].(mgobson.M)["name"], "dvara")
+
+		suffixProxy := &Proxy{ReplicaSet: &ReplicaSet{
+			Addr:           harness.addrs[0],
+			MaxConnections: 10,
+			AppendAppName:  true,
+		}}
+		ensure.Nil(t, suffixProxy.Start())
+		defer suffixProxy.Stop()
+
+		suffixAppName := appName + "-suffixed"
+		suffixClient, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+suffixProxy.Addr()).SetAppName(suffixAppName))
+		ensure.Nil(t, err)
+		defer suffixClient.Disconnect(ctx)
+		ensure.Nil(t, suffixClient.Ping(ctx, nil))
+
+		meta = clientMetadataByAppName(t, harness, suffixAppName+appNameSuffix)
+		ensure.DeepEqual(t, meta["application"].(mgobson.M)["name"], suffixAppName+appNameSuffix)
+	})
+}
+
+// clientMetadataByAppName polls $currentOp on the real primary, bypassing
+// the proxy, for a connection whose clientMetadata.application.name is
+// appName, returning that metadata document.
+func clientMetadataByAppName(t *testing.T, harness *ReplicaSetHarness, appName string) mgobson.M {
+	t.Helper()
+	session := harness.RealSession()
+	defer session.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var result mgobson.M
+		err := session.DB("admin").Run(mgobson.D{
+			{Name: "aggregate", Value: 1},
+			{Name: "pipeline", Value: []mgobson.M{
+				{"$currentOp": mgobson.M{"allUsers": true, "idleConnections": true}},
+			}},
+			{Name: "cursor", Value: mgobson.M{}},
+		}, &result)
+		if err == nil {
+			if cursor, ok := result["cursor"].(mgobson.M); ok {
+				if batch, ok := cursor["firstBatch"].([]interface{}); ok {
+					for _, e := range batch {
+						op, ok := e.(mgobson.M)
+						if !ok {
+							continue
+						}
+						meta, ok := op["clientMetadata"].(mgobson.M)
+						if !ok {
+							continue
+						}
+						if app, ok := meta["application"].(mgobson.M); ok && app["name"] == appName {
+							return meta
+						}
+					}
+				}
+			}
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Fatalf("no connection found with application.name %q", appName)
+	return nil
+}
+
+// TestLegacyHandshakeMetadata drives a raw isMaster handshake over the
+// legacy OP_QUERY command protocol against admin.$cmd, the way every
+// driver — even an OP_MSG-capable one — sends the very first hello on a
+// brand new connection, since it can't yet know the server's wire version.
+// It asserts dvara tags the client metadata on this path too, not only on
+// handshakes that happen to arrive over OP_MSG.
+func TestLegacyHandshakeMetadata(t *testing.T) {
+	withHarness(t, func(harness *ReplicaSetHarness) {
+		conn, err := net.Dial("tcp", harness.proxy.Addr())
+		ensure.Nil(t, err)
+		defer conn.Close()
+
+		appName := fmt.Sprintf("dvara-legacy-handshake-test-%d", time.Now().UnixNano())
+		query, err := mgobson.Marshal(mgobson.D{
+			{Name: "isMaster", Value: 1},
+			{Name: "client", Value: mgobson.D{
+				{Name: "application", Value: mgobson.D{{Name: "name", Value: appName}}},
+				{Name: "driver", Value: mgobson.D{
+					{Name: "name", Value: "dvara-test"},
+					{Name: "version", Value: "0.0.0"},
+				}},
+			}},
+		})
+		ensure.Nil(t, err)
+
+		msg := &legacyQueryMessage{
+			FullCollectionName: "admin.$cmd",
+			NumberToReturn:     -1,
+			Query:              mgobson.Raw{Kind: 0x03, Data: query},
+		}
+		ensure.Nil(t, msg.writeTo(conn))
+
+		header, err := readMsgHeader(conn)
+		ensure.Nil(t, err)
+		_, err = io.CopyN(ioutil.Discard, conn, int64(header.MessageLength)-msgHeaderLen)
+		ensure.Nil(t, err)
+
+		meta := clientMetadataByAppName(t, harness, appName)
+		ensure.DeepEqual(t, meta["application"].(mgobson.M)["name"], appName)
+		ensure.DeepEqual(t, meta["proxy"].(mgobson.M)["name"], "dvara")
+	})
+}
+
+func randomUUID() []byte {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return b
+}
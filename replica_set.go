@@ -0,0 +1,30 @@
+package dvara
+
+// ReplicaSet describes a single upstream mongo replica set member and the
+// pooling parameters the Proxy in front of it should use.
+type ReplicaSet struct {
+	// Addr is the "host:port" of the upstream mongod this replica set
+	// entry proxies to.
+	Addr string
+
+	// MaxConnections must be non-zero: a value of 0 is rejected by
+	// Proxy.Start. The Proxy does not otherwise cap its upstream
+	// connections; it dials one for every client connection it accepts.
+	MaxConnections int
+
+	// Stats collects counters for this member's proxy, such as the
+	// number of logical sessions dvara is tracking on its behalf.
+	Stats Stats
+
+	// Affinity pins the upstream connection a logical session's commands
+	// are dispatched to, so multi-statement transactions and causally
+	// consistent reads land on the same mongod socket regardless of
+	// which client connection carries them.
+	Affinity sessionAffinity
+
+	// AppendAppName causes dvara to append its own suffix to the
+	// application.name the client reports in its isMaster/hello
+	// handshake, so DBAs can tell proxied traffic apart from direct
+	// connections in $currentOp and the server log.
+	AppendAppName bool
+}
@@ -0,0 +1,90 @@
+package dvara
+
+import (
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// trackedSession is an lsid paired with the generation of the sessionAffinity
+// entry this connection pinned it against, so it can be released against
+// that exact pin later rather than whatever newer pin has since replaced
+// it at the same lsid after an idle timeout.
+type trackedSession struct {
+	lsid       bson.Raw
+	generation uint64
+}
+
+// clientSessionTracker accumulates the logical sessions a single client
+// connection has used, so they can be released in one shot when the
+// connection goes away instead of the server waiting out its 30 minute
+// idle timeout.
+type clientSessionTracker struct {
+	mutex    sync.Mutex
+	sessions []trackedSession
+	seen     map[string]bool
+	borrowed []*pinnedUpstream
+}
+
+func newClientSessionTracker() *clientSessionTracker {
+	return &clientSessionTracker{seen: make(map[string]bool)}
+}
+
+// observe records that the lsid carried by a forwarded command, if any, has
+// been seen on this connection, and reports whether it hadn't been seen
+// before. It does not by itself remember the lsid for later release —
+// callers that get true back are expected to follow up with recordSession
+// once they know which affinity generation it was pinned against.
+func (t *clientSessionTracker) observe(msg *OpMsgMessage) bool {
+	lsid, ok := msg.LSID()
+	if !ok {
+		return false
+	}
+	key := string(lsid.Data)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.seen[key] {
+		return false
+	}
+	t.seen[key] = true
+	return true
+}
+
+// recordSession remembers lsid and the generation of the affinity entry it
+// was pinned against, so it can be released precisely when this connection
+// goes away.
+func (t *clientSessionTracker) recordSession(lsid bson.Raw, generation uint64) {
+	t.mutex.Lock()
+	t.sessions = append(t.sessions, trackedSession{lsid: lsid, generation: generation})
+	t.mutex.Unlock()
+}
+
+// sessionIDs returns every distinct session observed so far on this
+// connection.
+func (t *clientSessionTracker) sessionIDs() []trackedSession {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	out := make([]trackedSession, len(t.sessions))
+	copy(out, t.sessions)
+	return out
+}
+
+// addBorrowed records an upstream connection pinned by, and shared from,
+// another client connection, so it can be released when this connection
+// goes away instead of being relied on forever.
+func (t *clientSessionTracker) addBorrowed(up *pinnedUpstream) {
+	t.mutex.Lock()
+	t.borrowed = append(t.borrowed, up)
+	t.mutex.Unlock()
+}
+
+// borrowedUpstreams returns every upstream connection this connection has
+// borrowed via session affinity.
+func (t *clientSessionTracker) borrowedUpstreams() []*pinnedUpstream {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	out := make([]*pinnedUpstream, len(t.borrowed))
+	copy(out, t.borrowed)
+	return out
+}
@@ -0,0 +1,39 @@
+package dvara
+
+import "sync/atomic"
+
+// Stats holds process counters exposed for monitoring a ReplicaSet's proxy.
+// All fields are updated atomically and may be read concurrently via their
+// accessor methods.
+type Stats struct {
+	activeSessions int64
+	sessionsEnded  int64
+	killFailures   int64
+}
+
+func (s *Stats) sessionOpened() {
+	atomic.AddInt64(&s.activeSessions, 1)
+}
+
+func (s *Stats) sessionsClosed(n int64) {
+	atomic.AddInt64(&s.activeSessions, -n)
+	atomic.AddInt64(&s.sessionsEnded, n)
+}
+
+func (s *Stats) killFailed() {
+	atomic.AddInt64(&s.killFailures, 1)
+}
+
+// ActiveSessions is the number of distinct lsids dvara currently believes
+// are open on the upstream member.
+func (s *Stats) ActiveSessions() int64 { return atomic.LoadInt64(&s.activeSessions) }
+
+// SessionsEnded is the number of lsids dvara no longer considers open: both
+// those it explicitly released via a synthesized endSessions command, and
+// those whose affinity pin simply idle-expired past sessionIdleTimeout on
+// the server side before dvara got a chance to end them itself.
+func (s *Stats) SessionsEnded() int64 { return atomic.LoadInt64(&s.sessionsEnded) }
+
+// KillFailures is the number of times dvara failed to deliver an
+// endSessions command upstream.
+func (s *Stats) KillFailures() int64 { return atomic.LoadInt64(&s.killFailures) }